@@ -0,0 +1,114 @@
+// +build linux,apparmor
+
+package apparmor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Supported is true when this binary was built with the apparmor tag, i.e.
+// Resolve below can actually apply a profile rather than always erroring.
+const Supported = true
+
+// EnsureDefaultProfile loads CRI-O's generated default profile into the
+// kernel under name if it isn't already loaded. It is safe to call on every
+// sandbox creation; loading an already-loaded profile is a cheap no-op for
+// apparmor_parser.
+func EnsureDefaultProfile(name string) error {
+	if !IsEnabled() {
+		return nil
+	}
+	loaded, err := isLoaded(name)
+	if err != nil {
+		return errors.Wrap(err, "checking loaded apparmor profiles")
+	}
+	if loaded {
+		return nil
+	}
+	profile := fmt.Sprintf(defaultProfileTemplate, name)
+	cmd := exec.Command("apparmor_parser", "-Kr")
+	cmd.Stdin = strings.NewReader(profile)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "loading default apparmor profile %s: %s", name, out)
+	}
+	return nil
+}
+
+// Resolve turns selector (as returned by ProfileSelector) into the profile
+// name CRI-O should set on the OCI spec, loading the default profile into
+// the kernel if it is selected and not already present.
+func Resolve(selector string) (string, error) {
+	switch {
+	case selector == "" || selector == ProfileUnconfined:
+		return "", nil
+	case selector == ProfileRuntimeDefault:
+		if err := EnsureDefaultProfile(DefaultProfileName); err != nil {
+			return "", err
+		}
+		return DefaultProfileName, nil
+	case strings.HasPrefix(selector, ProfileNamePrefix):
+		name := strings.TrimPrefix(selector, ProfileNamePrefix)
+		loaded, err := isLoaded(name)
+		if err != nil {
+			return "", errors.Wrap(err, "checking loaded apparmor profiles")
+		}
+		if !loaded {
+			return "", errors.Errorf("apparmor profile %q is not loaded on this node", name)
+		}
+		return name, nil
+	default:
+		return "", errors.Errorf("invalid apparmor profile selector %q", selector)
+	}
+}
+
+func isLoaded(name string) (bool, error) {
+	profiles, err := ioutil.ReadFile("/sys/kernel/security/apparmor/profiles")
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(profiles), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// defaultProfileTemplate is a conservative, mostly-unconfined profile similar
+// in spirit to Docker's and Podman's generated defaults: it denies writing to
+// procfs/sysfs knobs commonly abused for container breakout while otherwise
+// allowing normal workload behavior.
+const defaultProfileTemplate = `#include <tunables/global>
+
+profile %s flags=(attach_disconnected,mediate_deleted) {
+  #include <abstractions/base>
+
+  network,
+  capability,
+  file,
+  umount,
+
+  deny @{PROC}/* w,
+  deny @{PROC}/sys/[^k]** w,
+  deny @{PROC}/sys/kernel/{?,??,[^s][^h][^m]**} w,
+  deny @{PROC}/sysrq-trigger rwklx,
+  deny @{PROC}/mem rwklx,
+  deny @{PROC}/kmem rwklx,
+  deny @{PROC}/kcore rwklx,
+
+  deny mount,
+
+  deny /sys/[^f]*/** wklx,
+  deny /sys/f[^s]*/** wklx,
+  deny /sys/fs/[^c]*/** wklx,
+  deny /sys/fs/c[^g]*/** wklx,
+  deny /sys/fs/cg[^r]*/** wklx,
+  deny /sys/firmware/efi/efivars/** rwklx,
+  deny /sys/kernel/security/** rwklx,
+}
+`
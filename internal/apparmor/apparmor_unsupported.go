@@ -0,0 +1,27 @@
+// +build !linux !apparmor
+
+package apparmor
+
+import "github.com/pkg/errors"
+
+// Supported is false on builds without the apparmor tag: it makes IsEnabled
+// return false regardless of what the kernel exposes, so a binary built
+// without AppArmor support never reaches this file's Resolve and fails a
+// pod on an AppArmor-enabled kernel it simply can't confine.
+const Supported = false
+
+// EnsureDefaultProfile is a no-op on platforms/builds without AppArmor
+// support; IsEnabled already guards callers from reaching here in practice.
+func EnsureDefaultProfile(name string) error {
+	return nil
+}
+
+// Resolve fails on unsupported builds for every selector other than an
+// empty one or unconfined, which resolve to no profile. Callers must check IsEnabled
+// before calling Resolve so a non-AppArmor build never reaches this path.
+func Resolve(selector string) (string, error) {
+	if selector == "" || selector == ProfileUnconfined {
+		return "", nil
+	}
+	return "", errors.New("apparmor is not supported on this node")
+}
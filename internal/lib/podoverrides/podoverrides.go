@@ -0,0 +1,165 @@
+// Package podoverrides parses the well-known io.kubernetes.cri-o.* pod
+// annotations that let a workload tune resource limits on its own infra
+// container, and applies them to an OCI spec generator. Each of the keys
+// it recognizes is gated by an operator-controlled allow-list (crio.conf's
+// allowed_annotations), mirroring how default_capabilities centralizes
+// control over a similarly sensitive knob: a recognized but disallowed key
+// is a hard error, so cluster operators can reason about exactly which
+// annotations their tenants may set. Parse runs well before the rest of
+// runPodSandbox has consumed its own io.kubernetes.cri-o.* annotations
+// (ShmSize, apparmor profile, namespace targets, ...), so it must ignore
+// every key it doesn't itself own rather than rejecting the pod outright.
+package podoverrides
+
+import (
+	"strconv"
+	"strings"
+
+	units "github.com/docker/go-units"
+	"github.com/opencontainers/runtime-tools/generate"
+	"github.com/pkg/errors"
+)
+
+const (
+	annotationPrefix = "io.kubernetes.cri-o."
+
+	// UlimitPrefix is followed by the ulimit name, e.g.
+	// "io.kubernetes.cri-o.Ulimit.nofile".
+	UlimitPrefix  = annotationPrefix + "Ulimit."
+	OOMScoreAdj   = annotationPrefix + "OOMScoreAdj"
+	CPUShares     = annotationPrefix + "CPUShares"
+	CPUQuota      = annotationPrefix + "CPUQuota"
+	MemorySwap    = annotationPrefix + "MemorySwap"
+	// UlimitWildcard, present in allowed_annotations, permits every
+	// "io.kubernetes.cri-o.Ulimit.*" annotation instead of enumerating
+	// each ulimit name individually.
+	UlimitWildcard = UlimitPrefix + "*"
+)
+
+// Overrides holds the parsed, not-yet-applied value of every recognized
+// annotation found on a sandbox.
+type Overrides struct {
+	Ulimits     map[string]string
+	OOMScoreAdj *int
+	CPUShares   *uint64
+	CPUQuota    *int64
+	MemorySwap  *int64
+}
+
+// Parse reads this package's recognized io.kubernetes.cri-o.* annotations
+// out of sandboxAnnotations, rejecting any of them that aren't present in
+// allowed. Every other io.kubernetes.cri-o.* annotation is left alone: it
+// may be owned by a different part of runPodSandbox, consumed later in the
+// same request. It returns nil, nil when the pod declares none of the keys
+// this package owns.
+func Parse(sandboxAnnotations map[string]string, allowed []string) (*Overrides, error) {
+	allowedSet := make(map[string]bool, len(allowed))
+	for _, a := range allowed {
+		allowedSet[a] = true
+	}
+
+	var o *Overrides
+	ensure := func() *Overrides {
+		if o == nil {
+			o = &Overrides{Ulimits: map[string]string{}}
+		}
+		return o
+	}
+
+	for key, value := range sandboxAnnotations {
+		switch {
+		case strings.HasPrefix(key, UlimitPrefix):
+			if !allowedSet[key] && !allowedSet[UlimitWildcard] {
+				return nil, errors.Errorf("annotation %q is not in allowed_annotations", key)
+			}
+			ensure().Ulimits[strings.TrimPrefix(key, UlimitPrefix)] = value
+
+		case key == OOMScoreAdj:
+			if !allowedSet[key] {
+				return nil, errors.Errorf("annotation %q is not in allowed_annotations", key)
+			}
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing %s", key)
+			}
+			ensure().OOMScoreAdj = &v
+
+		case key == CPUShares:
+			if !allowedSet[key] {
+				return nil, errors.Errorf("annotation %q is not in allowed_annotations", key)
+			}
+			v, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing %s", key)
+			}
+			ensure().CPUShares = &v
+
+		case key == CPUQuota:
+			if !allowedSet[key] {
+				return nil, errors.Errorf("annotation %q is not in allowed_annotations", key)
+			}
+			v, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing %s", key)
+			}
+			ensure().CPUQuota = &v
+
+		case key == MemorySwap:
+			if !allowedSet[key] {
+				return nil, errors.Errorf("annotation %q is not in allowed_annotations", key)
+			}
+			v, err := units.RAMInBytes(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing %s", key)
+			}
+			ensure().MemorySwap = &v
+
+		default:
+			// Not one of ours: could be any other io.kubernetes.cri-o.*
+			// annotation consumed elsewhere in runPodSandbox, or not a
+			// cri-o annotation at all. Either way, not our business.
+			continue
+		}
+	}
+
+	return o, nil
+}
+
+// Apply sets every parsed override on g. It is a no-op when o is nil, so
+// callers can call Apply on Parse's result without checking it for nil.
+func (o *Overrides) Apply(g *generate.Generator) error {
+	if o == nil {
+		return nil
+	}
+	for name, value := range o.Ulimits {
+		soft, hard, err := parseUlimitValue(name, value)
+		if err != nil {
+			return errors.Wrapf(err, "parsing ulimit %s", name)
+		}
+		g.AddProcessRlimits("RLIMIT_"+strings.ToUpper(name), hard, soft)
+	}
+	if o.OOMScoreAdj != nil {
+		g.SetProcessOOMScoreAdj(*o.OOMScoreAdj)
+	}
+	if o.CPUShares != nil {
+		g.SetLinuxResourcesCPUShares(*o.CPUShares)
+	}
+	if o.CPUQuota != nil {
+		g.SetLinuxResourcesCPUQuota(*o.CPUQuota)
+	}
+	if o.MemorySwap != nil {
+		g.SetLinuxResourcesMemorySwap(*o.MemorySwap)
+	}
+	return nil
+}
+
+// parseUlimitValue accepts the same "soft:hard" or bare "value" syntax
+// docker/go-units uses for the --ulimit flag, e.g. "nofile=1024:4096".
+// name must be one of the ulimit names go-units knows (e.g. "nofile").
+func parseUlimitValue(name, value string) (soft, hard uint64, err error) {
+	u, err := units.ParseUlimit(name + "=" + value)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(u.Soft), uint64(u.Hard), nil
+}
@@ -0,0 +1,188 @@
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/cri-o/cri-o/pkg/config"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// NSType identifies a kind of Linux namespace CRI-O can pin and manage the
+// lifecycle of independently of any single container.
+type NSType string
+
+const (
+	NETNS  NSType = "net"
+	IPCNS  NSType = "ipc"
+	UTSNS  NSType = "uts"
+	USERNS NSType = "user"
+	// PIDNS is pinned by CreateManagedPIDNamespace, which keeps a pause
+	// process alive inside it, and can be resolved as a share target (see
+	// resolveNamespaceTarget in the server package); CreateManagedNamespaces
+	// does not accept it.
+	PIDNS NSType = "pid"
+	// CGROUPNS and TIMENS are the runtime-spec namespaces added after
+	// NET/IPC/UTS/USER; pinning them keeps a pod's cgroup-ns view and
+	// clock offset stable across container restarts within the pod.
+	CGROUPNS NSType = "cgroup"
+	TIMENS   NSType = "time"
+)
+
+// defaultNamespacesDir is used when crio.conf doesn't set namespaces_dir.
+const defaultNamespacesDir = "/var/run/crio/ns"
+
+// ManagedNamespace is a namespace CRI-O pinned with a bind mount so its
+// lifetime isn't tied to any single container process. Its Path() is
+// suitable for g.AddOrReplaceLinuxNamespace.
+type ManagedNamespace struct {
+	nsType NSType
+	nsPath string
+	// proc is set only for a PIDNS entry created by CreateManagedPIDNamespace:
+	// unlike the pinns-managed types, a PID namespace has a pause process
+	// keeping it alive that RemoveManagedNamespaces must reap before it
+	// unmounts the pin, or the process leaks for as long as the node runs.
+	proc *os.Process
+}
+
+// Type returns which kind of namespace this is.
+func (m *ManagedNamespace) Type() NSType { return m.nsType }
+
+// Path returns the bind-mounted path backing the namespace, or "" if this
+// namespace type wasn't actually pinned (the caller should leave the
+// runtime's default for that namespace alone).
+func (m *ManagedNamespace) Path() string { return m.nsPath }
+
+// CreateManagedNamespaces pins nsTypes as bind mounts under cfg's configured
+// namespaces directory via the pinns helper, and records them on the
+// sandbox so RemoveManagedNamespaces can tear them down later.
+//
+// If USERNS is among nsTypes, idMappings must be non-nil; pinns creates and
+// enters the user namespace before unsharing any of the others, since that
+// is the order runc's nsenter (and the kernel itself) require: once a
+// process has joined a new user namespace, its privilege to unshare further
+// namespaces is evaluated against the mapped root, not the host root.
+func (s *Sandbox) CreateManagedNamespaces(nsTypes []NSType, idMappings *idtools.IDMappings, cfg *config.Config) ([]*ManagedNamespace, error) {
+	if len(nsTypes) == 0 {
+		return nil, nil
+	}
+
+	nsDir := cfg.NamespacesDir
+	if nsDir == "" {
+		nsDir = defaultNamespacesDir
+	}
+	sandboxNsDir := filepath.Join(nsDir, s.id)
+	if err := os.MkdirAll(sandboxNsDir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "creating sandbox namespaces dir")
+	}
+
+	// pinns unshares and bind-mounts every requested namespace itself, in
+	// the order given, which is how the USERNS-first ordering constraint
+	// above is actually satisfied: we always pass --user (if requested)
+	// before the other namespace flags.
+	args := []string{"-d", sandboxNsDir, "-f", s.id}
+	ordered := orderWithUserNSFirst(nsTypes)
+	for _, t := range ordered {
+		switch t {
+		case NETNS:
+			args = append(args, "--net")
+		case IPCNS:
+			args = append(args, "--ipc")
+		case UTSNS:
+			args = append(args, "--uts")
+		case USERNS:
+			if idMappings == nil {
+				return nil, errors.New("user namespace requested without uid/gid mappings")
+			}
+			args = append(args, "--user")
+			for _, m := range idMappings.UIDs() {
+				args = append(args, fmt.Sprintf("--uid-mapping=%d:%d:%d", m.ContainerID, m.HostID, m.Size))
+			}
+			for _, m := range idMappings.GIDs() {
+				args = append(args, fmt.Sprintf("--gid-mapping=%d:%d:%d", m.ContainerID, m.HostID, m.Size))
+			}
+		case CGROUPNS:
+			args = append(args, "--cgroup")
+		case TIMENS:
+			args = append(args, "--time")
+		default:
+			return nil, errors.Errorf("unsupported managed namespace type %q", t)
+		}
+	}
+
+	if err := runPinns(args); err != nil {
+		return nil, err
+	}
+
+	managed := make([]*ManagedNamespace, 0, len(ordered))
+	for _, t := range ordered {
+		managed = append(managed, &ManagedNamespace{nsType: t, nsPath: pinPath(sandboxNsDir, s.id, t)})
+	}
+	// Append rather than overwrite: a PID namespace pinned earlier by
+	// CreateManagedPIDNamespace (ManagePIDNSLifecycle) must stay in the
+	// list alongside whatever this call pins, or its entry - and the pause
+	// process RemoveManagedNamespaces needs to reap - gets dropped.
+	s.managedNamespaces = append(s.managedNamespaces, managed...)
+	return managed, nil
+}
+
+// RemoveManagedNamespaces tears down every namespace CreateManagedNamespaces
+// pinned. It is safe to call more than once: unmounting an already-removed
+// pin or removing an already-unlinked file is treated as success, so a
+// caller retrying after a partial failure converges instead of erroring
+// forever on the entries it already cleaned up.
+func (s *Sandbox) RemoveManagedNamespaces() error {
+	var firstErr error
+	for _, ns := range s.managedNamespaces {
+		if ns.proc != nil {
+			if err := ns.proc.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+				if firstErr == nil {
+					firstErr = errors.Wrapf(err, "killing %s namespace pause process", ns.Type())
+				}
+			}
+			_, _ = ns.proc.Wait()
+		}
+		if ns.Path() == "" {
+			continue
+		}
+		if err := unix.Unmount(ns.Path(), unix.MNT_DETACH); err != nil && err != unix.EINVAL && !os.IsNotExist(err) {
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "unmounting %s namespace", ns.Type())
+			}
+			continue
+		}
+		if err := os.Remove(ns.Path()); err != nil && !os.IsNotExist(err) {
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "removing pinned %s namespace file", ns.Type())
+			}
+		}
+	}
+	if firstErr == nil {
+		s.managedNamespaces = nil
+	}
+	return firstErr
+}
+
+// orderWithUserNSFirst returns nsTypes with USERNS moved to the front, if
+// present, leaving the relative order of the rest unchanged.
+func orderWithUserNSFirst(nsTypes []NSType) []NSType {
+	ordered := make([]NSType, 0, len(nsTypes))
+	for _, t := range nsTypes {
+		if t == USERNS {
+			ordered = append(ordered, t)
+		}
+	}
+	for _, t := range nsTypes {
+		if t != USERNS {
+			ordered = append(ordered, t)
+		}
+	}
+	return ordered
+}
+
+func pinPath(sandboxNsDir, prefix string, t NSType) string {
+	return filepath.Join(sandboxNsDir, prefix+"-"+string(t)+"ns")
+}
@@ -0,0 +1,83 @@
+// +build linux
+
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/cri-o/cri-o/pkg/config"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// defaultPauseBin is CRI-O's own tiny pause binary, distinct from the pod's
+// pause *image* (PauseCommand/PauseImage): its only job is to sit in a new
+// PID namespace so the namespace stays alive across container restarts.
+const defaultPauseBin = "/usr/libexec/crio/pause"
+
+// CreateManagedPIDNamespace spawns a pause process inside a fresh PID
+// namespace and pins it next to the sandbox's other managed namespaces,
+// appending PIDNS to ManagedNamespaces. Unlike NET/IPC/UTS/USER, a PID
+// namespace dies the moment nothing is left running inside it, so pinns'
+// unshare-and-bind-mount approach doesn't work here: something has to stay
+// alive in the namespace, which is exactly what Podman/conmon's own pause
+// process does.
+//
+// The returned cleanup func must be run if runPodSandbox fails before the
+// namespace is ever handed to RemoveManagedNamespaces's normal teardown
+// path; it just delegates to RemoveManagedNamespaces, which knows (via the
+// ManagedNamespace's pinned process) to kill the pause process and unmount
+// the pin, in that order, so a still-starting container never gets a
+// namespace whose pause process already exited.
+func (s *Sandbox) CreateManagedPIDNamespace(cfg *config.Config) (*ManagedNamespace, func() error, error) {
+	nsDir := cfg.NamespacesDir
+	if nsDir == "" {
+		nsDir = defaultNamespacesDir
+	}
+	sandboxNsDir := filepath.Join(nsDir, s.id)
+	if err := os.MkdirAll(sandboxNsDir, 0o755); err != nil {
+		return nil, nil, errors.Wrap(err, "creating sandbox namespaces dir")
+	}
+
+	pauseBin := cfg.PinnedPauseCommand
+	if pauseBin == "" {
+		pauseBin = defaultPauseBin
+	}
+
+	cmd := exec.Command(pauseBin)
+	cmd.SysProcAttr = &unix.SysProcAttr{Cloneflags: unix.CLONE_NEWPID}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, errors.Wrapf(err, "starting pid namespace pause process %s", pauseBin)
+	}
+
+	pinFile := pinPath(sandboxNsDir, s.id, PIDNS)
+	if err := pinProcessNamespace(cmd.Process.Pid, "pid", pinFile); err != nil {
+		_ = cmd.Process.Kill()
+		_, _ = cmd.Process.Wait()
+		return nil, nil, err
+	}
+
+	ns := &ManagedNamespace{nsType: PIDNS, nsPath: pinFile, proc: cmd.Process}
+	s.managedNamespaces = append(s.managedNamespaces, ns)
+
+	return ns, s.RemoveManagedNamespaces, nil
+}
+
+// pinProcessNamespace bind-mounts /proc/<pid>/ns/<kind> onto a freshly
+// created file at pinPath, keeping the namespace alive independent of pid.
+func pinProcessNamespace(pid int, kind, pinPath string) error {
+	f, err := os.OpenFile(pinPath, os.O_CREATE|os.O_RDONLY, 0o444)
+	if err != nil {
+		return errors.Wrap(err, "creating namespace pin file")
+	}
+	f.Close()
+
+	src := fmt.Sprintf("/proc/%d/ns/%s", pid, kind)
+	if err := unix.Mount(src, pinPath, "", unix.MS_BIND, ""); err != nil {
+		return errors.Wrapf(err, "bind-mounting %s namespace pin", kind)
+	}
+	return nil
+}
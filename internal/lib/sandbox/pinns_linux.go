@@ -0,0 +1,20 @@
+// +build linux
+
+package sandbox
+
+import (
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// runPinns shells out to the pinns helper binary, which unshares and
+// bind-mounts the namespaces described by args and then exits, leaving the
+// bind mounts as the only thing keeping each namespace alive.
+func runPinns(args []string) error {
+	cmd := exec.Command("pinns", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "pinns %v: %s", args, out)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+// Package sandbox implements the in-memory representation of a running pod
+// sandbox: the state runPodSandbox computes once and that every later CRI
+// call (status, stop, remove, exec) needs back again.
+package sandbox
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cri-o/cri-o/internal/oci"
+	"github.com/pkg/errors"
+	pb "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/kubernetes/pkg/kubelet/dockershim/network/hostport"
+)
+
+// DevShmPath is the in-container mountpoint CRI-O bind mounts the pod's
+// shared /dev/shm tmpfs onto.
+const DevShmPath = "/dev/shm"
+
+// DefaultShmSize is the size, in bytes, of the /dev/shm tmpfs CRI-O mounts
+// for a pod when nothing more specific overrides it.
+const DefaultShmSize = 64 * 1024 * 1024
+
+// Sandbox is CRI-O's bookkeeping for a pod sandbox: the infra container plus
+// every workload container running inside it, and the namespace/cgroup/shm
+// state runPodSandbox assembled when the sandbox was created.
+type Sandbox struct {
+	id             string
+	namespace      string
+	name           string
+	kubeName       string
+	logDir         string
+	labels         map[string]string
+	annotations    map[string]string
+	processLabel   string
+	mountLabel     string
+	metadata       *pb.PodSandboxMetadata
+	shmPath        string
+	cgroupParent   string
+	privileged     bool
+	runtimeHandler string
+	resolvPath     string
+	hostnamePath   string
+	hostname       string
+	portMappings   []*hostport.PortMapping
+	hostNetwork    bool
+	ips            []string
+	nsOpts         *pb.NamespaceOption
+	seccompProfile string
+	created        time.Time
+
+	infraContainer *oci.Container
+
+	containersLock sync.Mutex
+	containers     map[string]*oci.Container
+
+	managedNamespaces []*ManagedNamespace
+
+	stateLock               sync.Mutex
+	namespaceCleanupPending bool
+}
+
+// New builds the Sandbox bookkeeping for a pod once runPodSandbox has
+// resolved every one of these fields from the CRI request.
+func New(id, namespace, name, kubeName, logDir string, labels, annotations map[string]string,
+	processLabel, mountLabel string, metadata *pb.PodSandboxMetadata, shmPath, cgroupParent string,
+	privileged bool, runtimeHandler, resolvPath, hostname string, portMappings []*hostport.PortMapping,
+	hostNetwork bool) (*Sandbox, error) {
+	if id == "" {
+		return nil, errors.New("cannot create sandbox with empty id")
+	}
+	return &Sandbox{
+		id:             id,
+		namespace:      namespace,
+		name:           name,
+		kubeName:       kubeName,
+		logDir:         logDir,
+		labels:         labels,
+		annotations:    annotations,
+		processLabel:   processLabel,
+		mountLabel:     mountLabel,
+		metadata:       metadata,
+		shmPath:        shmPath,
+		cgroupParent:   cgroupParent,
+		privileged:     privileged,
+		runtimeHandler: runtimeHandler,
+		resolvPath:     resolvPath,
+		hostname:       hostname,
+		portMappings:   portMappings,
+		hostNetwork:    hostNetwork,
+		containers:     make(map[string]*oci.Container),
+	}, nil
+}
+
+func (s *Sandbox) ID() string                           { return s.id }
+func (s *Sandbox) Namespace() string                     { return s.namespace }
+func (s *Sandbox) Name() string                          { return s.name }
+func (s *Sandbox) KubeName() string                      { return s.kubeName }
+func (s *Sandbox) LogDir() string                        { return s.logDir }
+func (s *Sandbox) Labels() map[string]string             { return s.labels }
+func (s *Sandbox) Annotations() map[string]string        { return s.annotations }
+func (s *Sandbox) ProcessLabel() string                  { return s.processLabel }
+func (s *Sandbox) MountLabel() string                    { return s.mountLabel }
+func (s *Sandbox) Metadata() *pb.PodSandboxMetadata       { return s.metadata }
+func (s *Sandbox) ShmPath() string                        { return s.shmPath }
+func (s *Sandbox) CgroupParent() string                   { return s.cgroupParent }
+func (s *Sandbox) Privileged() bool                       { return s.privileged }
+func (s *Sandbox) RuntimeHandler() string                 { return s.runtimeHandler }
+func (s *Sandbox) ResolvPath() string                     { return s.resolvPath }
+func (s *Sandbox) Hostname() string                       { return s.hostname }
+func (s *Sandbox) PortMappings() []*hostport.PortMapping  { return s.portMappings }
+func (s *Sandbox) HostNetwork() bool                      { return s.hostNetwork }
+
+// AddIPs records the IP addresses CNI assigned the sandbox's network
+// namespace, so they can be reported back in PodSandboxStatus.
+func (s *Sandbox) AddIPs(ips []string) { s.ips = ips }
+
+// IPs returns the IP addresses previously recorded with AddIPs.
+func (s *Sandbox) IPs() []string { return s.ips }
+
+// SetNamespaceOptions records the CRI NamespaceOption the sandbox was
+// created with, so later lookups (e.g. resolving another sandbox/container
+// as a share target) can see what was requested.
+func (s *Sandbox) SetNamespaceOptions(nsOpts *pb.NamespaceOption) { s.nsOpts = nsOpts }
+
+// NamespaceOptions returns the value set by SetNamespaceOptions.
+func (s *Sandbox) NamespaceOptions() *pb.NamespaceOption { return s.nsOpts }
+
+// SetSeccompProfilePath records the seccomp profile path applied to the
+// infra container, for status reporting.
+func (s *Sandbox) SetSeccompProfilePath(path string) { s.seccompProfile = path }
+
+// SeccompProfilePath returns the value set by SetSeccompProfilePath.
+func (s *Sandbox) SeccompProfilePath() string { return s.seccompProfile }
+
+// SetCreated records the sandbox's creation time. It is expected to be
+// called once, after the infra container has actually started.
+func (s *Sandbox) SetCreated() { s.created = time.Now() }
+
+// Created returns the time set by SetCreated.
+func (s *Sandbox) Created() time.Time { return s.created }
+
+// SetNamespaceCleanupPending records whether a prior attempt to tear down
+// this sandbox's managed namespaces (RemoveManagedNamespaces) failed
+// partway through. While true, the sandbox must not be dropped from the
+// store: the pinned namespace files it still references would otherwise
+// leak with no handle left to retry the cleanup.
+func (s *Sandbox) SetNamespaceCleanupPending(pending bool) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	s.namespaceCleanupPending = pending
+}
+
+// NamespaceCleanupPending reports whether RemoveManagedNamespaces needs to
+// be retried before this sandbox can be safely removed.
+func (s *Sandbox) NamespaceCleanupPending() bool {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.namespaceCleanupPending
+}
+
+// AddHostnamePath records the path of the /etc/hostname bind mount file so
+// it can be cleaned up when the sandbox is removed.
+func (s *Sandbox) AddHostnamePath(path string) { s.hostnamePath = path }
+
+// HostnamePath returns the path set by AddHostnamePath, if any.
+func (s *Sandbox) HostnamePath() string { return s.hostnamePath }
+
+// SetInfraContainer records the infra (pause) container backing the
+// sandbox. It may only be called once.
+func (s *Sandbox) SetInfraContainer(c *oci.Container) error {
+	if s.infraContainer != nil {
+		return errors.New("sandbox already has an infra container")
+	}
+	s.infraContainer = c
+	return nil
+}
+
+// InfraContainer returns the sandbox's pause container.
+func (s *Sandbox) InfraContainer() *oci.Container { return s.infraContainer }
+
+// ManagedNamespaces returns the namespaces CreateManagedNamespaces pinned
+// for this sandbox, so another sandbox that wants to join one of them (see
+// the server package's resolveNamespaceTarget) can find its bind mount.
+func (s *Sandbox) ManagedNamespaces() []*ManagedNamespace { return s.managedNamespaces }
+
+// AddContainer registers a workload container as running inside the
+// sandbox, so it is included in operations that act on the whole pod (e.g.
+// checkpointing).
+func (s *Sandbox) AddContainer(c *oci.Container) {
+	s.containersLock.Lock()
+	defer s.containersLock.Unlock()
+	s.containers[c.ID()] = c
+}
+
+// RemoveContainer drops a workload container from the sandbox's bookkeeping.
+func (s *Sandbox) RemoveContainer(c *oci.Container) {
+	s.containersLock.Lock()
+	defer s.containersLock.Unlock()
+	delete(s.containers, c.ID())
+}
+
+// Containers returns every workload container currently running in the
+// sandbox, in no particular order.
+func (s *Sandbox) Containers() []*oci.Container {
+	s.containersLock.Lock()
+	defer s.containersLock.Unlock()
+	containers := make([]*oci.Container, 0, len(s.containers))
+	for _, c := range s.containers {
+		containers = append(containers, c)
+	}
+	return containers
+}
@@ -0,0 +1,552 @@
+// +build linux
+
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containers/libpod/pkg/annotations"
+	libsandbox "github.com/cri-o/cri-o/internal/lib/sandbox"
+	"github.com/cri-o/cri-o/internal/log"
+	spec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	pb "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"k8s.io/kubernetes/pkg/kubelet/dockershim/network/hostport"
+)
+
+// sandboxCheckpointManifest captures everything runPodSandbox computes from
+// the CRI request that can't be recovered from the container's OCI spec
+// alone, so RestorePodSandbox can replay the same pod construction.
+type sandboxCheckpointManifest struct {
+	ID               string            `json:"id"`
+	Name             string            `json:"name"`
+	Namespace        string            `json:"namespace"`
+	KubeName         string            `json:"kubeName"`
+	Labels           map[string]string `json:"labels"`
+	Annotations      map[string]string `json:"annotations"`
+	MetadataJSON     string            `json:"metadataJson"`
+	NsOptsJSON       string            `json:"nsOptsJson"`
+	PortMappingsJSON string            `json:"portMappingsJson"`
+	LogDir           string            `json:"logDir"`
+	ProcessLabel     string            `json:"processLabel"`
+	MountLabel       string            `json:"mountLabel"`
+	ShmPath          string            `json:"shmPath"`
+	CgroupParent     string            `json:"cgroupParent"`
+	ResolvPath       string            `json:"resolvPath"`
+	HostnamePath     string            `json:"hostnamePath"`
+	Hostname         string            `json:"hostname"`
+	RuntimeHandler   string            `json:"runtimeHandler"`
+	Privileged       bool              `json:"privileged"`
+	HostNetwork      bool              `json:"hostNetwork"`
+	CNIResult        json.RawMessage   `json:"cniResult,omitempty"`
+	Containers       []string          `json:"containers"`
+}
+
+// CheckpointPodSandboxOptions controls how CheckpointPodSandbox checkpoints
+// the sandbox's processes.
+type CheckpointPodSandboxOptions struct {
+	// LeaveRunning checkpoints the sandbox without killing its processes,
+	// so it keeps serving while the archive is shipped elsewhere.
+	LeaveRunning bool
+}
+
+// RestorePodSandboxOptions controls how RestorePodSandbox replays an archive
+// produced by CheckpointPodSandbox.
+type RestorePodSandboxOptions struct {
+	// ID overrides the sandbox ID recorded in the manifest: the sandbox and
+	// its infra container are restored under this ID. Workload containers
+	// are restored under the IDs recorded in the manifest.
+	ID string
+	// ShmPath, if set, overrides where the archived /dev/shm contents are
+	// copied back to. It defaults to the manifest's own recorded shm path.
+	ShmPath string
+}
+
+// CheckpointPodSandbox freezes the infra container and every workload
+// container in sb via `runc checkpoint`, then bundles the resulting
+// criu images together with a manifest of the pod-level state runPodSandbox
+// computed at creation time into a single gzipped tar archive at destPath.
+func (s *Server) CheckpointPodSandbox(ctx context.Context, sb *libsandbox.Sandbox, destPath string, opts *CheckpointPodSandboxOptions) error {
+	if opts == nil {
+		opts = &CheckpointPodSandboxOptions{}
+	}
+
+	workDir, err := ioutilTempDir(s.config.ContainerAttachSocketDir, "checkpoint-"+sb.ID())
+	if err != nil {
+		return errors.Wrap(err, "creating checkpoint work dir")
+	}
+	defer os.RemoveAll(workDir)
+
+	containers := sb.Containers()
+	names := make([]string, 0, len(containers)+1)
+	names = append(names, sb.ID())
+	for _, c := range containers {
+		names = append(names, c.ID())
+	}
+
+	for _, id := range names {
+		imageDir := filepath.Join(workDir, id)
+		if err := os.MkdirAll(imageDir, 0700); err != nil {
+			return err
+		}
+		args := []string{"checkpoint", "--image-path", imageDir}
+		if opts.LeaveRunning {
+			args = append(args, "--leave-running")
+		}
+		args = append(args, id)
+		cmd := exec.CommandContext(ctx, "runc", args...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "runc checkpoint %s: %s", id, out)
+		}
+	}
+
+	metadataJSON, err := json.Marshal(sb.Metadata())
+	if err != nil {
+		return errors.Wrap(err, "marshaling sandbox metadata")
+	}
+	nsOptsJSON, err := json.Marshal(sb.NamespaceOptions())
+	if err != nil {
+		return errors.Wrap(err, "marshaling sandbox namespace options")
+	}
+	portMappingsJSON, err := json.Marshal(sb.PortMappings())
+	if err != nil {
+		return errors.Wrap(err, "marshaling sandbox port mappings")
+	}
+
+	manifest := sandboxCheckpointManifest{
+		ID:               sb.ID(),
+		Name:             sb.Name(),
+		Namespace:        sb.Namespace(),
+		KubeName:         sb.KubeName(),
+		Labels:           sb.Labels(),
+		Annotations:      sb.Annotations(),
+		MetadataJSON:     string(metadataJSON),
+		NsOptsJSON:       string(nsOptsJSON),
+		PortMappingsJSON: string(portMappingsJSON),
+		LogDir:           sb.LogDir(),
+		ProcessLabel:     sb.ProcessLabel(),
+		MountLabel:       sb.MountLabel(),
+		ShmPath:          sb.ShmPath(),
+		CgroupParent:     sb.CgroupParent(),
+		ResolvPath:       sb.ResolvPath(),
+		HostnamePath:     sb.HostnamePath(),
+		Hostname:         sb.Hostname(),
+		RuntimeHandler:   sb.RuntimeHandler(),
+		Privileged:       sb.Privileged(),
+		HostNetwork:      sb.HostNetwork(),
+		CNIResult:        cniResultAnnotation(sb),
+		Containers:       names[1:],
+	}
+	manifestBytes, err := json.Marshal(&manifest)
+	if err != nil {
+		return err
+	}
+	if err := writeFileBytes(filepath.Join(workDir, "manifest.json"), manifestBytes); err != nil {
+		return err
+	}
+
+	if sb.ShmPath() != "" {
+		if err := copyDirContents(sb.ShmPath(), filepath.Join(workDir, "shm")); err != nil {
+			return errors.Wrap(err, "archiving shm contents")
+		}
+	}
+
+	if err := tarDirectory(workDir, destPath); err != nil {
+		return errors.Wrap(err, "archiving checkpoint")
+	}
+
+	log.Infof(ctx, "checkpointed pod sandbox %s to %s", sb.ID(), destPath)
+	return nil
+}
+
+// RestorePodSandbox unpacks archivePath, replays the pod-level sandbox state
+// the manifest recorded (reconstructing managed namespaces and networking as
+// runPodSandbox would for a brand new sandbox) if no live sandbox already
+// exists under the manifest's ID, and then calls `runc restore` for the
+// infra container and every workload container it contains. It does not
+// mount a tmpfs for /dev/shm: the archived /dev/shm files are copied into
+// the shm path as it exists on the node, after the containers are restored.
+//
+// bundleDir must already hold each container's OCI bundle
+// (bundleDir/<id>/config.json plus its rootfs); RestorePodSandbox reads and
+// rewrites the infra container's config.json in place to apply the
+// namespace paths it sets up, but does not provision storage itself.
+func (s *Server) RestorePodSandbox(ctx context.Context, archivePath, bundleDir string, opts *RestorePodSandboxOptions) (*sandboxCheckpointManifest, error) {
+	workDir, err := ioutilTempDir(s.config.ContainerAttachSocketDir, "restore-")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating restore work dir")
+	}
+	defer os.RemoveAll(workDir)
+
+	if err := untarDirectory(archivePath, workDir); err != nil {
+		return nil, errors.Wrap(err, "extracting checkpoint archive")
+	}
+
+	manifestBytes, err := os.ReadFile(filepath.Join(workDir, "manifest.json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading checkpoint manifest")
+	}
+	var manifest sandboxCheckpointManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, errors.Wrap(err, "parsing checkpoint manifest")
+	}
+	// The archive's criu image dirs are named by the checkpointed IDs.
+	archivedID := manifest.ID
+	if opts != nil && opts.ID != "" {
+		manifest.ID = opts.ID
+	}
+
+	shmPath := manifest.ShmPath
+	if opts != nil && opts.ShmPath != "" {
+		shmPath = opts.ShmPath
+	}
+
+	if s.GetSandbox(manifest.ID) == nil {
+		if _, err := s.replaySandboxFromManifest(ctx, &manifest, bundleDir); err != nil {
+			return nil, errors.Wrap(err, "replaying sandbox from checkpoint manifest")
+		}
+	}
+
+	names := append([]string{manifest.ID}, manifest.Containers...)
+	for i, id := range names {
+		imageDir := filepath.Join(workDir, id)
+		if i == 0 {
+			imageDir = filepath.Join(workDir, archivedID)
+		}
+		cmd := exec.CommandContext(ctx, "runc", "restore",
+			"--image-path", imageDir,
+			"--bundle", filepath.Join(bundleDir, id),
+			"--detach",
+			id)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return nil, errors.Wrapf(err, "runc restore %s: %s", id, out)
+		}
+	}
+
+	if shmPath != "" {
+		if shmContents := filepath.Join(workDir, "shm"); dirExists(shmContents) {
+			if err := copyDirContents(shmContents, shmPath); err != nil {
+				return nil, errors.Wrap(err, "restoring shm contents")
+			}
+		}
+	}
+
+	log.Infof(ctx, "restored pod sandbox %s from %s", manifest.ID, archivePath)
+	return &manifest, nil
+}
+
+// replaySandboxFromManifest rebuilds the in-memory Sandbox and the host-side
+// state runPodSandbox would have set up for it (managed namespaces, pod
+// networking, and the infra container's namespace paths on disk) from a
+// checkpoint manifest, so RestorePodSandbox can resume frozen processes into
+// it. It mirrors runPodSandbox's own namespace/network setup instead of
+// duplicating it, reusing configureGeneratorForSandboxNamespaces against a
+// Generator loaded from the infra container's existing OCI bundle.
+func (s *Server) replaySandboxFromManifest(ctx context.Context, manifest *sandboxCheckpointManifest, bundleDir string) (sb *libsandbox.Sandbox, err error) {
+	var metadata pb.PodSandboxMetadata
+	if err := json.Unmarshal([]byte(manifest.MetadataJSON), &metadata); err != nil {
+		return nil, errors.Wrap(err, "parsing checkpoint sandbox metadata")
+	}
+	var nsOpts pb.NamespaceOption
+	if manifest.NsOptsJSON != "" {
+		if err := json.Unmarshal([]byte(manifest.NsOptsJSON), &nsOpts); err != nil {
+			return nil, errors.Wrap(err, "parsing checkpoint namespace options")
+		}
+	}
+	var portMappings []*hostport.PortMapping
+	if manifest.PortMappingsJSON != "" {
+		if err := json.Unmarshal([]byte(manifest.PortMappingsJSON), &portMappings); err != nil {
+			return nil, errors.Wrap(err, "parsing checkpoint port mappings")
+		}
+	}
+
+	sb, err = libsandbox.New(manifest.ID, manifest.Namespace, manifest.Name, manifest.KubeName, manifest.LogDir,
+		manifest.Labels, manifest.Annotations, manifest.ProcessLabel, manifest.MountLabel, &metadata,
+		manifest.ShmPath, manifest.CgroupParent, manifest.Privileged, manifest.RuntimeHandler,
+		manifest.ResolvPath, manifest.Hostname, portMappings, manifest.HostNetwork)
+	if err != nil {
+		return nil, errors.Wrap(err, "rebuilding sandbox from checkpoint manifest")
+	}
+	sb.SetNamespaceOptions(&nsOpts)
+	if manifest.HostnamePath != "" {
+		sb.AddHostnamePath(manifest.HostnamePath)
+	}
+
+	namespaceCleanupPending := false
+
+	if err := s.addSandbox(sb); err != nil {
+		return nil, errors.Wrap(err, "registering restored sandbox")
+	}
+	defer func() {
+		if err != nil && !namespaceCleanupPending {
+			if err2 := s.removeSandbox(manifest.ID); err2 != nil {
+				log.Warnf(ctx, "could not remove restored pod sandbox %s: %v", manifest.ID, err2)
+			}
+		}
+	}()
+
+	if err := s.PodIDIndex().Add(manifest.ID); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil && !namespaceCleanupPending {
+			if err2 := s.PodIDIndex().Delete(manifest.ID); err2 != nil {
+				log.Warnf(ctx, "couldn't delete restored pod id %s from idIndex", manifest.ID)
+			}
+		}
+	}()
+
+	hostNetwork := manifest.HostNetwork
+	hostIPC := nsOpts.GetIpc() == pb.NamespaceMode_NODE
+	hostPID := nsOpts.GetPid() == pb.NamespaceMode_NODE
+
+	specPath := filepath.Join(bundleDir, manifest.ID, "config.json")
+	specBytes, err := os.ReadFile(specPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading restored infra container's OCI spec")
+	}
+	var ociSpec spec.Spec
+	if err := json.Unmarshal(specBytes, &ociSpec); err != nil {
+		return nil, errors.Wrap(err, "parsing restored infra container's OCI spec")
+	}
+	g := generate.NewFromSpec(&ociSpec)
+
+	cleanupFuncs, err := s.configureGeneratorForSandboxNamespaces(hostNetwork, hostIPC, hostPID, &nsOpts, sb, g)
+	for idx := range cleanupFuncs {
+		defer func(currentFunc int) {
+			if err != nil {
+				if err2 := cleanupFuncs[currentFunc](); err2 != nil {
+					log.Warnf(ctx, "failed to clean up namespaces for restored sandbox %s, marking for retry: %v", manifest.ID, err2)
+					sb.SetNamespaceCleanupPending(true)
+					namespaceCleanupPending = true
+				}
+			}
+		}(idx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.config.ManageNSLifecycle {
+		var ips []string
+		var result cnitypes.Result
+		ips, result, err = s.networkStart(ctx, sb)
+		if err != nil {
+			return nil, err
+		}
+		sb.AddIPs(ips)
+		if result != nil {
+			resultCurrent, err := current.NewResultFromResult(result)
+			if err != nil {
+				return nil, err
+			}
+			cniResultJSON, err := json.Marshal(resultCurrent)
+			if err != nil {
+				return nil, err
+			}
+			g.AddAnnotation(annotations.CNIResult, string(cniResultJSON))
+		}
+		defer func() {
+			if err != nil {
+				if err2 := s.networkStop(ctx, sb); err2 != nil {
+					log.Errorf(ctx, "error stopping network on restore cleanup: %v", err2)
+				}
+			}
+		}()
+	}
+
+	if err := g.SaveToFile(specPath, generate.ExportOptions{}); err != nil {
+		return nil, errors.Wrap(err, "writing restored infra container's OCI spec")
+	}
+
+	sb.SetCreated()
+	return sb, nil
+}
+
+// CheckpointPodSandboxByID resolves id to its in-memory Sandbox and
+// checkpoints it. This is the entry point a crioctl-style CLI or a future
+// CRI checkpoint/restore extension RPC should call, since a gRPC or CLI
+// caller has a sandbox ID, not a live *libsandbox.Sandbox; CheckpointPodSandbox
+// itself stays ID-agnostic so callers that already hold the Sandbox (e.g.
+// tests) don't need a store round trip.
+func (s *Server) CheckpointPodSandboxByID(ctx context.Context, id, destPath string, opts *CheckpointPodSandboxOptions) error {
+	sb := s.GetSandbox(id)
+	if sb == nil {
+		return errors.Errorf("no such pod sandbox %s", id)
+	}
+	return s.CheckpointPodSandbox(ctx, sb, destPath, opts)
+}
+
+// cniResultAnnotation returns the CNI result JSON runPodSandbox recorded on
+// the infra container's spec, if any, for inclusion in the checkpoint
+// manifest's CNIResult field.
+func cniResultAnnotation(sb *libsandbox.Sandbox) json.RawMessage {
+	ic := sb.InfraContainer()
+	if ic == nil || ic.Spec() == nil {
+		return nil
+	}
+	raw, ok := ic.Spec().Annotations[annotations.CNIResult]
+	if !ok || raw == "" {
+		return nil
+	}
+	return json.RawMessage(raw)
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// copyDirContents copies every file and directory under srcDir into dstDir,
+// creating dstDir if it doesn't already exist. It's used to move /dev/shm's
+// contents into and out of a checkpoint archive's working directory, mirroring
+// tarDirectory/untarDirectory's own directory walk.
+func copyDirContents(srcDir, dstDir string) error {
+	if err := os.MkdirAll(dstDir, 0700); err != nil {
+		return err
+	}
+	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		target := filepath.Join(dstDir, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		_, err = io.Copy(out, src)
+		return err
+	})
+}
+
+func ioutilTempDir(base, prefix string) (string, error) {
+	if base == "" {
+		base = os.TempDir()
+	}
+	if err := os.MkdirAll(base, 0700); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(base, prefix)
+}
+
+func writeFileBytes(path string, data []byte) error {
+	return os.WriteFile(path, data, 0600)
+}
+
+func tarDirectory(srcDir, destPath string) error {
+	f, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	defer gw.Close()
+	tw := tar.NewWriter(gw)
+	defer tw.Close()
+
+	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+}
+
+func untarDirectory(archivePath, destDir string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(destDir, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil { // nolint: gosec
+				out.Close()
+				return err
+			}
+			out.Close()
+		default:
+			return fmt.Errorf("unsupported checkpoint archive entry type for %s", hdr.Name)
+		}
+	}
+}
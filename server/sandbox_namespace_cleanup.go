@@ -0,0 +1,36 @@
+// +build linux
+
+package server
+
+import (
+	libsandbox "github.com/cri-o/cri-o/internal/lib/sandbox"
+	"github.com/cri-o/cri-o/internal/log"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// RetryNamespaceCleanup re-runs sb's RemoveManagedNamespaces after a
+// previous attempt left it with NamespaceCleanupPending set. Each cleanup
+// func is safe to call more than once (stale bind mounts and already
+// removed pin files are treated as success), so callers can invoke this
+// repeatedly until kubelet's own retry loop converges.
+//
+// runPodSandbox calls this for the sandbox ReservePodIDAndName resolves to,
+// since a kubelet retry of a failed RunPodSandbox reuses that same id and
+// would otherwise leave it stuck with a NamespaceCleanupPending sandbox it
+// can never ask about again. StopPodSandbox and RemovePodSandbox must call
+// this too before they allow the sandbox to actually be dropped from the
+// store, so a sandbox stopped or removed outside of a RunPodSandbox retry
+// doesn't leak its pinned namespace files either; neither handler exists in
+// this tree yet to wire it into.
+func (s *Server) RetryNamespaceCleanup(ctx context.Context, sb *libsandbox.Sandbox) error {
+	if !sb.NamespaceCleanupPending() {
+		return nil
+	}
+	if err := sb.RemoveManagedNamespaces(); err != nil {
+		log.Warnf(ctx, "retrying namespace cleanup for sandbox %s still failing: %v", sb.ID(), err)
+		return errors.Wrap(err, "retrying managed namespace cleanup")
+	}
+	sb.SetNamespaceCleanupPending(false)
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	cnitypes "github.com/containernetworking/cni/pkg/types"
@@ -18,12 +19,16 @@ import (
 	"github.com/containers/libpod/pkg/annotations"
 	"github.com/containers/libpod/pkg/cgroups"
 	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/cri-o/cri-o/internal/apparmor"
 	"github.com/cri-o/cri-o/internal/lib"
+	"github.com/cri-o/cri-o/internal/lib/podoverrides"
 	libsandbox "github.com/cri-o/cri-o/internal/lib/sandbox"
 	"github.com/cri-o/cri-o/internal/log"
 	oci "github.com/cri-o/cri-o/internal/oci"
 	"github.com/cri-o/cri-o/pkg/config"
 	"github.com/cri-o/cri-o/pkg/sandbox"
+	units "github.com/docker/go-units"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/runc/libcontainer/cgroups/systemd"
 	spec "github.com/opencontainers/runtime-spec/specs-go"
@@ -40,6 +45,39 @@ import (
 const cgroupMemorySubsystemMountPathV1 = "/sys/fs/cgroup/memory"
 const cgroupMemorySubsystemMountPathV2 = "/sys/fs/cgroup"
 
+// ShmSizeAnnotation lets a workload request a /dev/shm tmpfs larger (or
+// smaller) than the configured default, in go-units syntax (e.g. "2G").
+// It is ignored, with a warning, for pods sharing the host IPC namespace.
+const ShmSizeAnnotation = "io.kubernetes.cri-o.ShmSize"
+
+// shmSizeForSandbox resolves the effective /dev/shm size for a pod, in order
+// of precedence: the per-pod annotation, the runtime handler's configured
+// default, and finally the process-wide default.
+func (s *Server) shmSizeForSandbox(sandboxAnnotations map[string]string, runtimeHandler string) (int64, error) {
+	size := int64(libsandbox.DefaultShmSize)
+	if handler, ok := s.config.Runtimes[runtimeHandler]; ok && handler.ShmSize != "" {
+		handlerSize, err := units.RAMInBytes(handler.ShmSize)
+		if err != nil {
+			return 0, errors.Wrapf(err, "parsing shm_size for runtime handler %q", runtimeHandler)
+		}
+		size = handlerSize
+	}
+
+	if raw, ok := sandboxAnnotations[ShmSizeAnnotation]; ok && raw != "" {
+		annotationSize, err := units.RAMInBytes(raw)
+		if err != nil {
+			return 0, errors.Wrapf(err, "parsing %s annotation", ShmSizeAnnotation)
+		}
+		size = annotationSize
+	}
+
+	if s.config.MaxShmSize > 0 && size > s.config.MaxShmSize {
+		return 0, errors.Errorf("requested shm size %d exceeds the configured maximum of %d", size, s.config.MaxShmSize)
+	}
+
+	return size, nil
+}
+
 func (s *Server) runPodSandbox(ctx context.Context, req *pb.RunPodSandboxRequest) (resp *pb.RunPodSandboxResponse, err error) {
 	s.updateLock.RLock()
 	defer s.updateLock.RUnlock()
@@ -50,6 +88,7 @@ func (s *Server) runPodSandbox(ctx context.Context, req *pb.RunPodSandboxRequest
 	}
 
 	pathsToChown := []string{}
+	namespaceCleanupPending := false
 
 	// we need to fill in the container name, as it is not present in the request. Luckily, it is a constant.
 	log.Infof(ctx, "attempting to run pod sandbox with infra container: %s%s", translateLabelsToDescription(sbox.Config().GetLabels()), leaky.PodInfraContainerName)
@@ -62,19 +101,59 @@ func (s *Server) runPodSandbox(ctx context.Context, req *pb.RunPodSandboxRequest
 	if err != nil {
 		return nil, err
 	}
+
+	// sb and cleanupFuncs are only filled in once the sandbox object exists
+	// and its namespaces are configured, further down. Declaring them (and
+	// the one-shot namespace cleanup they drive) here lets every error-path
+	// defer below call ensureNamespaceCleanup before deciding what to tear
+	// down, whichever of them happens to run first as the function unwinds.
+	var sb *libsandbox.Sandbox
+	var cleanupFuncs []func() error
+	var namespaceCleanupOnce sync.Once
+	ensureNamespaceCleanup := func() {
+		namespaceCleanupOnce.Do(func() {
+			for _, cleanup := range cleanupFuncs {
+				if err2 := cleanup(); err2 != nil {
+					log.Warnf(ctx, "failed to clean up namespaces for sandbox %s, marking for retry: %v", id, err2)
+					if sb != nil {
+						sb.SetNamespaceCleanupPending(true)
+					}
+					namespaceCleanupPending = true
+				}
+			}
+		})
+	}
+
 	defer func() {
 		if err != nil {
-			s.ReleasePodName(name)
+			ensureNamespaceCleanup()
+			if !namespaceCleanupPending {
+				s.ReleasePodName(name)
+			}
 		}
 	}()
 
+	// ReservePodIDAndName hands back the same id on a kubelet retry of a
+	// RunPodSandbox that previously got far enough to reserve the name. If
+	// that earlier attempt left its managed namespaces only partially torn
+	// down, retry the cleanup now instead of leaving it stuck forever under
+	// an id kubelet is about to stop asking about.
+	if existing := s.GetSandbox(id); existing != nil {
+		if err := s.RetryNamespaceCleanup(ctx, existing); err != nil {
+			return nil, err
+		}
+	}
+
 	containerName, err := s.ReserveSandboxContainerIDAndName(sbox.Config())
 	if err != nil {
 		return nil, err
 	}
 	defer func() {
 		if err != nil {
-			s.ReleaseContainerName(containerName)
+			ensureNamespaceCleanup()
+			if !namespaceCleanupPending {
+				s.ReleaseContainerName(containerName)
+			}
 		}
 	}()
 
@@ -108,8 +187,11 @@ func (s *Server) runPodSandbox(ctx context.Context, req *pb.RunPodSandboxRequest
 	}
 	defer func() {
 		if err != nil {
-			if err2 := s.StorageRuntimeServer().RemovePodSandbox(id); err2 != nil {
-				log.Warnf(ctx, "couldn't cleanup pod sandbox %q: %v", id, err2)
+			ensureNamespaceCleanup()
+			if !namespaceCleanupPending {
+				if err2 := s.StorageRuntimeServer().RemovePodSandbox(id); err2 != nil {
+					log.Warnf(ctx, "couldn't cleanup pod sandbox %q: %v", id, err2)
+				}
 			}
 		}
 	}()
@@ -225,6 +307,10 @@ func (s *Server) runPodSandbox(ctx context.Context, req *pb.RunPodSandboxRequest
 		return nil, err
 	}
 
+	if err := s.setupSandboxApparmor(&g, sbox.Config().GetAnnotations()); err != nil {
+		return nil, err
+	}
+
 	nsOptsJSON, err := json.Marshal(securityContext.GetNamespaceOptions())
 	if err != nil {
 		return nil, err
@@ -243,12 +329,28 @@ func (s *Server) runPodSandbox(ctx context.Context, req *pb.RunPodSandboxRequest
 	// Remove the default /dev/shm mount to ensure we overwrite it
 	g.RemoveMount(libsandbox.DevShmPath)
 
+	// validate the runtime handler
+	runtimeHandler, err := s.runtimeHandler(req)
+	if err != nil {
+		return nil, err
+	}
+
 	// create shm mount for the pod containers.
 	var shmPath string
 	if hostIPC {
+		if sbox.Config().GetAnnotations()[ShmSizeAnnotation] != "" {
+			log.Warnf(ctx, "ignoring %s annotation: pod uses host IPC namespace", ShmSizeAnnotation)
+		}
 		shmPath = libsandbox.DevShmPath
 	} else {
-		shmPath, err = setupShm(podContainer.RunDir, mountLabel)
+		var shmSize int64
+		shmSize, err = s.shmSizeForSandbox(sbox.Config().GetAnnotations(), runtimeHandler)
+		if err != nil {
+			return nil, err
+		}
+		g.AddAnnotation(annotations.ShmSize, strconv.FormatInt(shmSize, 10))
+
+		shmPath, err = setupShm(podContainer.RunDir, mountLabel, shmSize)
 		if err != nil {
 			return nil, err
 		}
@@ -282,8 +384,11 @@ func (s *Server) runPodSandbox(ctx context.Context, req *pb.RunPodSandboxRequest
 
 	defer func() {
 		if err != nil {
-			if err2 := s.CtrIDIndex().Delete(id); err2 != nil {
-				log.Warnf(ctx, "couldn't delete ctr id %s from idIndex", id)
+			ensureNamespaceCleanup()
+			if !namespaceCleanupPending {
+				if err2 := s.CtrIDIndex().Delete(id); err2 != nil {
+					log.Warnf(ctx, "couldn't delete ctr id %s from idIndex", id)
+				}
 			}
 		}
 	}()
@@ -304,12 +409,6 @@ func (s *Server) runPodSandbox(ctx context.Context, req *pb.RunPodSandboxRequest
 	}
 	g.SetHostname(hostname)
 
-	// validate the runtime handler
-	runtimeHandler, err := s.runtimeHandler(req)
-	if err != nil {
-		return nil, err
-	}
-
 	g.AddAnnotation(annotations.Metadata, string(metadataJSON))
 	g.AddAnnotation(annotations.Labels, string(labelsJSON))
 	g.AddAnnotation(annotations.Annotations, string(kubeAnnotationsJSON))
@@ -372,7 +471,7 @@ func (s *Server) runPodSandbox(ctx context.Context, req *pb.RunPodSandboxRequest
 		}
 	}
 
-	sb, err := libsandbox.New(id, namespace, name, kubeName, logDir, labels, kubeAnnotations, processLabel, mountLabel, metadata, shmPath, cgroupParent, privileged, runtimeHandler, resolvPath, hostname, portMappings, hostNetwork)
+	sb, err = libsandbox.New(id, namespace, name, kubeName, logDir, labels, kubeAnnotations, processLabel, mountLabel, metadata, shmPath, cgroupParent, privileged, runtimeHandler, resolvPath, hostname, portMappings, hostNetwork)
 	if err != nil {
 		return nil, err
 	}
@@ -382,8 +481,11 @@ func (s *Server) runPodSandbox(ctx context.Context, req *pb.RunPodSandboxRequest
 	}
 	defer func() {
 		if err != nil {
-			if err := s.removeSandbox(id); err != nil {
-				log.Warnf(ctx, "could not remove pod sandbox: %v", err)
+			ensureNamespaceCleanup()
+			if !namespaceCleanupPending {
+				if err := s.removeSandbox(id); err != nil {
+					log.Warnf(ctx, "could not remove pod sandbox: %v", err)
+				}
 			}
 		}
 	}()
@@ -394,8 +496,11 @@ func (s *Server) runPodSandbox(ctx context.Context, req *pb.RunPodSandboxRequest
 
 	defer func() {
 		if err != nil {
-			if err := s.PodIDIndex().Delete(id); err != nil {
-				log.Warnf(ctx, "couldn't delete pod id %s from idIndex", id)
+			ensureNamespaceCleanup()
+			if !namespaceCleanupPending {
+				if err := s.PodIDIndex().Delete(id); err != nil {
+					log.Warnf(ctx, "couldn't delete pod id %s from idIndex", id)
+				}
 			}
 		}
 	}()
@@ -421,18 +526,21 @@ func (s *Server) runPodSandbox(ctx context.Context, req *pb.RunPodSandboxRequest
 
 	g.SetLinuxResourcesCPUShares(PodInfraCPUshares)
 
-	// set up namespaces
-	cleanupFuncs, err := s.configureGeneratorForSandboxNamespaces(hostNetwork, hostIPC, hostPID, sb, g)
-	// We want to cleanup after ourselves if we are managing any namespaces and fail in this function.
-	for idx := range cleanupFuncs {
-		defer func(currentFunc int) {
-			if err != nil {
-				if err2 := cleanupFuncs[currentFunc](); err2 != nil {
-					log.Debugf(ctx, err2.Error())
-				}
-			}
-		}(idx)
+	// Let the workload raise specific ulimits or tune the infra container
+	// via well-known annotations, gated by crio.conf's allowed_annotations
+	// so cluster operators control which annotations tenants may use.
+	overrides, err := podoverrides.Parse(kubeAnnotations, s.config.AllowedAnnotations)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing pod override annotations")
+	}
+	if err := overrides.Apply(&g); err != nil {
+		return nil, errors.Wrap(err, "applying pod override annotations")
 	}
+
+	// set up namespaces. cleanupFuncs is run (once) by ensureNamespaceCleanup,
+	// called from the defers registered above and below, as the function
+	// unwinds on error.
+	cleanupFuncs, err = s.configureGeneratorForSandboxNamespaces(hostNetwork, hostIPC, hostPID, securityContext.GetNamespaceOptions(), sb, g)
 	if err != nil {
 		return nil, err
 	}
@@ -573,7 +681,10 @@ func (s *Server) runPodSandbox(ctx context.Context, req *pb.RunPodSandboxRequest
 	s.addInfraContainer(container)
 	defer func() {
 		if err != nil {
-			s.removeInfraContainer(container)
+			ensureNamespaceCleanup()
+			if !namespaceCleanupPending {
+				s.removeInfraContainer(container)
+			}
 		}
 	}()
 
@@ -639,12 +750,30 @@ func (s *Server) runPodSandbox(ctx context.Context, req *pb.RunPodSandboxRequest
 	return resp, nil
 }
 
-func setupShm(podSandboxRunDir, mountLabel string) (shmPath string, err error) {
+// setupSandboxApparmor resolves the AppArmor profile selector for the infra
+// container from the sandbox annotations, loading the profile into the
+// kernel if required, and sets it on the generator. It degrades cleanly when
+// the node's kernel has no AppArmor support, since many production kernels
+// are built without it.
+func (s *Server) setupSandboxApparmor(g *generate.Generator, sandboxAnnotations map[string]string) error {
+	if !apparmor.IsEnabled() {
+		return nil
+	}
+	selector := apparmor.ProfileSelector(sandboxAnnotations, leaky.PodInfraContainerName, s.config.DefaultApparmorProfile)
+	profile, err := apparmor.Resolve(selector)
+	if err != nil {
+		return errors.Wrap(err, "resolving apparmor profile for sandbox")
+	}
+	g.SetProcessApparmorProfile(profile)
+	return nil
+}
+
+func setupShm(podSandboxRunDir, mountLabel string, shmSize int64) (shmPath string, err error) {
 	shmPath = filepath.Join(podSandboxRunDir, "shm")
 	if err := os.Mkdir(shmPath, 0700); err != nil {
 		return "", err
 	}
-	shmOptions := "mode=1777,size=" + strconv.Itoa(libsandbox.DefaultShmSize)
+	shmOptions := "mode=1777,size=" + strconv.FormatInt(shmSize, 10)
 	if err = unix.Mount("shm", shmPath, "tmpfs", unix.MS_NOEXEC|unix.MS_NOSUID|unix.MS_NODEV,
 		label.FormatMountLabel(shmOptions, mountLabel)); err != nil {
 		return "", fmt.Errorf("failed to mount shm tmpfs for pod: %v", err)
@@ -754,13 +883,81 @@ func (s *Server) configureGeneratorForSysctls(ctx context.Context, g generate.Ge
 	}
 }
 
+// The CRI's NamespaceOption only carries a TargetId for PID (used by
+// ephemeral debug containers). NET/IPC/UTS have no equivalent in the API
+// CRI-O implements, so sharing those with another sandbox or container --
+// useful for service-mesh sidecar injectors joining a workload's netns --
+// goes through these CRI-O-specific annotations instead, the same way
+// Podman's --network/--ipc/--uts=container:<id> do.
+const (
+	netNsTargetAnnotation = "io.kubernetes.cri-o.NetNsTarget"
+	ipcNsTargetAnnotation = "io.kubernetes.cri-o.IpcNsTarget"
+	utsNsTargetAnnotation = "io.kubernetes.cri-o.UtsNsTarget"
+)
+
+// hostCgroupNsAnnotation and hostTimeNsAnnotation let a pod opt out of
+// CRI-O's managed cgroup/time namespaces and fall back to the runtime's
+// default (usually the host's), for workloads that depend on seeing the
+// host's cgroup or clock namespace.
+const (
+	hostCgroupNsAnnotation = "io.kubernetes.cri-o.HostCgroupns"
+	hostTimeNsAnnotation   = "io.kubernetes.cri-o.HostTimens"
+)
+
+// resolveNamespaceTarget finds the namespace path nsType should join for
+// targetID, which may name either another sandbox or a single container.
+// It prefers a pinned managed namespace (so the path survives the target's
+// own container restarts) and otherwise falls back to the live
+// /proc/<pid>/ns/<kind> of the target's current process, mirroring Podman's
+// addNamespaceContainer helper.
+func (s *Server) resolveNamespaceTarget(targetID string, nsType libsandbox.NSType) (string, error) {
+	if target := s.GetSandbox(targetID); target != nil {
+		for _, ns := range target.ManagedNamespaces() {
+			if ns.Type() == nsType && ns.Path() != "" {
+				return ns.Path(), nil
+			}
+		}
+		if infra := target.InfraContainer(); infra != nil {
+			return procNamespacePath(infra.State().Pid, nsType)
+		}
+		return "", errors.Errorf("target sandbox %s has no usable %s namespace", targetID, nsType)
+	}
+	if c := s.GetContainer(targetID); c != nil {
+		return procNamespacePath(c.State().Pid, nsType)
+	}
+	return "", errors.Errorf("no sandbox or container found for namespace target %q", targetID)
+}
+
+func procNamespacePath(pid int, nsType libsandbox.NSType) (string, error) {
+	kind, ok := map[libsandbox.NSType]string{
+		libsandbox.NETNS:  "net",
+		libsandbox.IPCNS:  "ipc",
+		libsandbox.UTSNS:  "uts",
+		libsandbox.PIDNS:  "pid",
+		libsandbox.USERNS: "user",
+	}[nsType]
+	if !ok {
+		return "", errors.Errorf("cannot resolve a /proc namespace path for type %q", nsType)
+	}
+	return fmt.Sprintf("/proc/%d/ns/%s", pid, kind), nil
+}
+
 // configureGeneratorForSandboxNamespaces set the linux namespaces for the generator, based on whether the pod is sharing namespaces with the host,
 // as well as whether CRI-O should be managing the namespace lifecycle.
 // it returns a slice of cleanup funcs, all of which are the respective NamespaceRemove() for the sandbox.
 // The caller should defer the cleanup funcs if there is an error, to make sure each namespace we are managing is properly cleaned up.
-func (s *Server) configureGeneratorForSandboxNamespaces(hostNetwork, hostIPC, hostPID bool, sb *libsandbox.Sandbox, g generate.Generator) (cleanupFuncs []func() error, err error) {
-	managedNamespaces := make([]libsandbox.NSType, 0, 3)
-	if hostNetwork {
+func (s *Server) configureGeneratorForSandboxNamespaces(hostNetwork, hostIPC, hostPID bool, nsOpts *pb.NamespaceOption, sb *libsandbox.Sandbox, g generate.Generator) (cleanupFuncs []func() error, err error) {
+	managedNamespaces := make([]libsandbox.NSType, 0, 4)
+
+	if targetID := sb.Annotations()[netNsTargetAnnotation]; targetID != "" {
+		path, terr := s.resolveNamespaceTarget(targetID, libsandbox.NETNS)
+		if terr != nil {
+			return nil, terr
+		}
+		if err = g.AddOrReplaceLinuxNamespace(string(spec.NetworkNamespace), path); err != nil {
+			return
+		}
+	} else if hostNetwork {
 		err = g.RemoveLinuxNamespace(string(spec.NetworkNamespace))
 		if err != nil {
 			return
@@ -769,7 +966,15 @@ func (s *Server) configureGeneratorForSandboxNamespaces(hostNetwork, hostIPC, ho
 		managedNamespaces = append(managedNamespaces, libsandbox.NETNS)
 	}
 
-	if hostIPC {
+	if targetID := sb.Annotations()[ipcNsTargetAnnotation]; targetID != "" {
+		path, terr := s.resolveNamespaceTarget(targetID, libsandbox.IPCNS)
+		if terr != nil {
+			return nil, terr
+		}
+		if err = g.AddOrReplaceLinuxNamespace(string(spec.IPCNamespace), path); err != nil {
+			return
+		}
+	} else if hostIPC {
 		err = g.RemoveLinuxNamespace(string(spec.IPCNamespace))
 		if err != nil {
 			return
@@ -778,20 +983,88 @@ func (s *Server) configureGeneratorForSandboxNamespaces(hostNetwork, hostIPC, ho
 		managedNamespaces = append(managedNamespaces, libsandbox.IPCNS)
 	}
 
-	// Since we need a process to hold open the PID namespace, CRI-O can't manage the NS lifecycle
-	if hostPID {
+	if targetID := sb.Annotations()[utsNsTargetAnnotation]; targetID != "" {
+		path, terr := s.resolveNamespaceTarget(targetID, libsandbox.UTSNS)
+		if terr != nil {
+			return nil, terr
+		}
+		if err = g.AddOrReplaceLinuxNamespace(string(spec.UTSNamespace), path); err != nil {
+			return
+		}
+	} else if s.config.ManageNSLifecycle {
+		managedNamespaces = append(managedNamespaces, libsandbox.UTSNS)
+	}
+
+	// Cgroup and time namespaces have no CRI-level NamespaceOption at all
+	// yet, so whether a pod opts out of CRI-O's managed default is decided
+	// entirely by these CRI-O-specific annotations. They're pinned by the
+	// same CreateManagedNamespaces/pinns call as NET/IPC/UTS/USER below, so
+	// ManageCgroupNSLifecycle only does anything when ManageNSLifecycle is
+	// also enabled; collecting the types here and silently dropping them
+	// otherwise would give the pod no cgroup/time namespace and no error.
+	if s.config.ManageCgroupNSLifecycle {
+		if !s.config.ManageNSLifecycle {
+			return nil, errors.New("manage_cgroup_ns_lifecycle requires manage_ns_lifecycle to be enabled")
+		}
+		if sb.Annotations()[hostCgroupNsAnnotation] != "true" {
+			managedNamespaces = append(managedNamespaces, libsandbox.CGROUPNS)
+		}
+		if sb.Annotations()[hostTimeNsAnnotation] != "true" {
+			managedNamespaces = append(managedNamespaces, libsandbox.TIMENS)
+		}
+	}
+
+	// The CRI already carries a TargetId for PID: pods (debug containers,
+	// service-mesh sidecar injectors) can join another sandbox's or
+	// container's PID namespace instead of getting the host's or their own.
+	if nsOpts.GetPid() == pb.NamespaceMode_TARGET && nsOpts.GetTargetId() != "" {
+		path, terr := s.resolveNamespaceTarget(nsOpts.GetTargetId(), libsandbox.PIDNS)
+		if terr != nil {
+			return nil, terr
+		}
+		if err = g.AddOrReplaceLinuxNamespace(string(spec.PIDNamespace), path); err != nil {
+			return
+		}
+	} else if hostPID {
 		err = g.RemoveLinuxNamespace(string(spec.PIDNamespace))
 		if err != nil {
 			return
 		}
+	} else if s.config.ManagePIDNSLifecycle {
+		var pidCleanup func() error
+		var pidNS *libsandbox.ManagedNamespace
+		pidNS, pidCleanup, err = sb.CreateManagedPIDNamespace(&s.config)
+		if err != nil {
+			return
+		}
+		cleanupFuncs = append(cleanupFuncs, pidCleanup)
+		if err = g.AddOrReplaceLinuxNamespace(string(spec.PIDNamespace), pidNS.Path()); err != nil {
+			return
+		}
+	}
+
+	var idMappings *idtools.IDMappings
+	if s.config.ManageUserNSLifecycle {
+		idMappings, err = userNSMappingsFromAnnotations(sb.Annotations())
+		if err != nil {
+			return cleanupFuncs, err
+		}
+	}
+	if idMappings != nil && !s.config.ManageNSLifecycle {
+		return cleanupFuncs, errors.New("a per-sandbox user namespace requires manage_ns_lifecycle to be enabled")
 	}
 
-	// There's no option to set hostUTS
 	if s.config.ManageNSLifecycle {
-		managedNamespaces = append(managedNamespaces, libsandbox.UTSNS)
+		if idMappings != nil {
+			// The user namespace must be created, and entered, before
+			// the namespaces above: once CreateManagedNamespaces joins
+			// it, the net/ipc/uts unshares it performs happen as the
+			// mapped root, which is what runc's nsenter expects.
+			managedNamespaces = append(managedNamespaces, libsandbox.USERNS)
+		}
 
 		// now that we've configured the namespaces we're sharing, tell sandbox to configure them
-		managedNamespaces, err := sb.CreateManagedNamespaces(managedNamespaces, &s.config)
+		managedNamespaces, err := sb.CreateManagedNamespaces(managedNamespaces, idMappings, &s.config)
 		if err != nil {
 			return nil, err
 		}
@@ -801,19 +1074,92 @@ func (s *Server) configureGeneratorForSandboxNamespaces(hostNetwork, hostIPC, ho
 		if err := configureGeneratorGivenNamespacePaths(managedNamespaces, g); err != nil {
 			return cleanupFuncs, err
 		}
+
+		if idMappings != nil {
+			for _, m := range idMappings.UIDs() {
+				g.AddLinuxUIDMapping(uint32(m.HostID), uint32(m.ContainerID), uint32(m.Size))
+			}
+			for _, m := range idMappings.GIDs() {
+				g.AddLinuxGIDMapping(uint32(m.HostID), uint32(m.ContainerID), uint32(m.Size))
+			}
+		}
 	}
 
 	return cleanupFuncs, err
 }
 
+// uidMappingsAnnotation and gidMappingsAnnotation carry the uid/gid mappings a pod wants for its
+// managed user namespace, as a comma-separated list of
+// "containerID:hostID:size" triples, identically for both the UID and GID
+// annotations: "io.kubernetes.cri-o.UIDMappings"/"...GIDMappings". The CRI's
+// SecurityContext has no first-class per-pod user namespace knob as of
+// v1alpha2, so annotations are the only channel available for this today.
+const (
+	uidMappingsAnnotation = "io.kubernetes.cri-o.UIDMappings"
+	gidMappingsAnnotation = "io.kubernetes.cri-o.GIDMappings"
+)
+
+// userNSMappingsFromAnnotations returns the uid/gid mappings requested for a
+// managed per-sandbox user namespace, or nil if the pod didn't ask for one.
+func userNSMappingsFromAnnotations(sandboxAnnotations map[string]string) (*idtools.IDMappings, error) {
+	uidStr, hasUIDs := sandboxAnnotations[uidMappingsAnnotation]
+	gidStr, hasGIDs := sandboxAnnotations[gidMappingsAnnotation]
+	if !hasUIDs && !hasGIDs {
+		return nil, nil
+	}
+	if !hasUIDs || !hasGIDs {
+		return nil, errors.Errorf("both %s and %s must be set to request a per-sandbox user namespace", uidMappingsAnnotation, gidMappingsAnnotation)
+	}
+
+	uids, err := parseIDMappings(uidStr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", uidMappingsAnnotation)
+	}
+	gids, err := parseIDMappings(gidStr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", gidMappingsAnnotation)
+	}
+	return idtools.NewIDMappingsFromMaps(uids, gids), nil
+}
+
+// parseIDMappings parses a comma-separated list of "containerID:hostID:size"
+// triples into idtools.IDMap entries.
+func parseIDMappings(value string) ([]idtools.IDMap, error) {
+	entries := strings.Split(value, ",")
+	mappings := make([]idtools.IDMap, 0, len(entries))
+	for _, entry := range entries {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			return nil, errors.Errorf("invalid mapping %q: expected containerID:hostID:size", entry)
+		}
+		containerID, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid containerID in %q", entry)
+		}
+		hostID, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid hostID in %q", entry)
+		}
+		size, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid size in %q", entry)
+		}
+		mappings = append(mappings, idtools.IDMap{ContainerID: containerID, HostID: hostID, Size: size})
+	}
+	return mappings, nil
+}
+
 // configureGeneratorGivenNamespacePaths takes a map of nsType -> nsPath. It configures the generator
 // to add or replace the defaults to these paths
 func configureGeneratorGivenNamespacePaths(managedNamespaces []*libsandbox.ManagedNamespace, g generate.Generator) error {
 	typeToSpec := map[libsandbox.NSType]spec.LinuxNamespaceType{
-		libsandbox.IPCNS:  spec.IPCNamespace,
-		libsandbox.NETNS:  spec.NetworkNamespace,
-		libsandbox.UTSNS:  spec.UTSNamespace,
-		libsandbox.USERNS: spec.UserNamespace,
+		libsandbox.IPCNS:    spec.IPCNamespace,
+		libsandbox.NETNS:    spec.NetworkNamespace,
+		libsandbox.UTSNS:    spec.UTSNamespace,
+		libsandbox.USERNS:   spec.UserNamespace,
+		libsandbox.PIDNS:    spec.PIDNamespace,
+		libsandbox.CGROUPNS: spec.CgroupNamespace,
+		libsandbox.TIMENS:   spec.TimeNamespace,
 	}
 
 	for _, ns := range managedNamespaces {